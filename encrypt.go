@@ -0,0 +1,74 @@
+/* ======================================================================== */
+/* encrypt.go - optional symmetric encryption envelope for output sinks     */
+/* ======================================================================== */
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+)
+
+var f_encrypt_key = flag.String("encrypt-key", "",
+	"Passphrase to encrypt output with AES-256-GCM, for untrusted networks "+
+		"a TLS sink can't cover (e.g. a UDP collector)")
+
+// sharedAEAD is non-nil once -encrypt-key is set, wrapping every sink's
+// Output so its wire format is identical regardless of scheme.
+var sharedAEAD cipher.AEAD
+
+// buildAEAD derives an AES-256 key from -encrypt-key with a single SHA-256
+// pass - this repo has no vendored crypto/pbkdf2, so a salted multi-round
+// KDF isn't available without adding a dependency - and returns the GCM
+// AEAD used to seal every output line.
+func buildAEAD() cipher.AEAD {
+	if *f_encrypt_key == "" {
+		return nil
+	}
+	key := sha256.Sum256([]byte(*f_encrypt_key))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		log.Fatalf("-encrypt-key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatalf("-encrypt-key: %v", err)
+	}
+	return aead
+}
+
+// encryptOutput wraps another Output, sealing each line as
+// len || nonce || AES-GCM(ciphertext||tag) before handing it on. The length
+// prefix is what lets the receiver find message boundaries on a stream
+// transport, since ciphertext has no natural delimiter of its own.
+type encryptOutput struct {
+	inner Output
+	aead  cipher.AEAD
+}
+
+func (o *encryptOutput) Reconnect() error { return o.inner.Reconnect() }
+func (o *encryptOutput) Close() error     { return o.inner.Close() }
+func (o *encryptOutput) Flush() error     { return o.inner.Flush() }
+
+func (o *encryptOutput) Write(p []byte) error {
+	nonce := make([]byte, o.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("encrypt: %v", err)
+	}
+
+	// Seal appends to its dst argument; passing nonce as dst gives us
+	// nonce||ciphertext||tag without a separate copy.
+	sealed := o.aead.Seal(nonce, nonce, p, nil)
+
+	frame := make([]byte, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	copy(frame[4:], sealed)
+
+	return o.inner.Write(frame)
+}
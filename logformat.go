@@ -0,0 +1,210 @@
+/* ======================================================================== */
+/* logformat.go - parses -input-format lines into a normalized log record   */
+/* ======================================================================== */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type levelMapSet map[string]string
+var levelMapFlag = make(levelMapSet)
+
+func (l *levelMapSet) String() string {
+	r, err := json.Marshal(*l)
+	if err != nil {
+		return fmt.Sprintf("levelMapSet Marshal error: %v", err)
+	}
+	return string(r)
+}
+
+// Set parses a comma-separated list of raw=canonical pairs, e.g.
+// "I=info,W=warn,E=error".
+func (l *levelMapSet) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		p := strings.SplitN(pair, "=", 2)
+		if len(p) < 2 {
+			log.Fatalf("-level-map '%s' must be specified as raw=level pairs", pair)
+		}
+		(*l)[p[0]] = p[1]
+	}
+	return nil
+}
+
+var f_input_format = flag.String("input-format", "line",
+	"Input format to parse (line/syslog/klog/json)")
+var f_min_level = flag.String("min-level", "",
+	"Drop lines below this normalized severity level before writing")
+
+var hostname, _ = os.Hostname()
+var pid = os.Getpid()
+
+// logRecord is the result of parsing a single input line under
+// -input-format. It carries the fields merged into the JSON envelope when
+// -output-mode=json; message text itself is threaded separately so -wrap
+// can still split it across several envelopes sharing one logRecord.
+type logRecord struct {
+	ts    time.Time
+	level string
+	extra map[string]interface{}
+}
+
+// parseInputLine parses raw according to -input-format, returning the
+// message text to format/wrap and the record to merge into the envelope.
+func parseInputLine(raw string) (string, *logRecord) {
+	switch *f_input_format {
+	case "syslog":
+		return parseSyslog(raw)
+	case "klog":
+		return parseKlog(raw)
+	case "json":
+		return parseJSON(raw)
+	default:
+		return raw, &logRecord{ts: time.Now()}
+	}
+}
+
+// mapLevel applies -level-map to a raw level token, falling back to a
+// lowercased copy of the token if the map has no entry for it.
+func mapLevel(token string) string {
+	if v, ok := levelMapFlag[token]; ok {
+		return v
+	}
+	return strings.ToLower(token)
+}
+
+// parseSyslog recognizes the "<PRI>rest" framing used by RFC 3164/5424
+// syslog producers and derives a level from the PRI's severity.
+var syslogSeverityNames = [8]string{
+	"emerg", "alert", "crit", "error", "warning", "notice", "info", "debug",
+}
+
+func parseSyslog(raw string) (string, *logRecord) {
+	rec := &logRecord{ts: time.Now()}
+
+	if len(raw) < 3 || raw[0] != '<' {
+		return raw, rec
+	}
+	end := strings.IndexByte(raw, '>')
+	if end < 1 {
+		return raw, rec
+	}
+	pri, err := strconv.Atoi(raw[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return raw, rec
+	}
+
+	rec.level = mapLevel(syslogSeverityNames[pri%8])
+	return raw[end+1:], rec
+}
+
+// parseKlog recognizes the klog/glog line header:
+// Lmmdd hh:mm:ss.uuuuuu rest...
+var klogRe = regexp.MustCompile(`^([IWEF])(\d{4}) (\d{2}:\d{2}:\d{2}\.\d{6})\s(.*)$`)
+
+var klogDefaultLevels = map[string]string{
+	"I": "info",
+	"W": "warn",
+	"E": "error",
+	"F": "fatal",
+}
+
+func parseKlog(raw string) (string, *logRecord) {
+	rec := &logRecord{ts: time.Now()}
+
+	m := klogRe.FindStringSubmatch(raw)
+	if m == nil {
+		return raw, rec
+	}
+	letter, mmdd, hms, rest := m[1], m[2], m[3], m[4]
+
+	layout := "20060102 15:04:05.000000"
+	stamp := fmt.Sprintf("%04d%s %s", time.Now().Year(), mmdd, hms)
+	if ts, err := time.ParseInLocation(layout, stamp, time.Local); err == nil {
+		rec.ts = ts
+	}
+
+	if v, ok := levelMapFlag[letter]; ok {
+		rec.level = v
+	} else {
+		rec.level = klogDefaultLevels[letter]
+	}
+
+	return rest, rec
+}
+
+// parseJSON treats raw as a JSON object and merges its fields directly into
+// the envelope instead of nesting the raw text under "message".
+func parseJSON(raw string) (string, *logRecord) {
+	rec := &logRecord{ts: time.Now()}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+		return raw, rec
+	}
+	rec.extra = obj
+
+	if lv, ok := jsonString(obj, "level", "lvl", "severity"); ok {
+		rec.level = mapLevel(lv)
+	}
+	if ts, ok := jsonString(obj, "ts", "time", "timestamp"); ok {
+		if parsed, err := time.Parse(time.RFC3339, ts); err == nil {
+			rec.ts = parsed
+		}
+	}
+
+	message, _ := jsonString(obj, "message", "msg")
+	return message, rec
+}
+
+func jsonString(obj map[string]interface{}, keys ...string) (string, bool) {
+	for _, k := range keys {
+		if v, ok := obj[k]; ok {
+			if s, ok := v.(string); ok {
+				return s, true
+			}
+		}
+	}
+	return "", false
+}
+
+// levelSeverity ranks normalized level names for -min-level filtering.
+// Aliases map to the same rank as their canonical name.
+var levelSeverity = map[string]int{
+	"debug":   0,
+	"info":    1,
+	"notice":  1,
+	"warn":    2,
+	"warning": 2,
+	"error":   3,
+	"crit":    4,
+	"alert":   4,
+	"fatal":   5,
+	"emerg":   5,
+}
+
+// passesMinLevel reports whether rec should be kept under -min-level. Lines
+// with no recognized level, or when -min-level isn't set, always pass.
+func passesMinLevel(rec *logRecord) bool {
+	if *f_min_level == "" || rec.level == "" {
+		return true
+	}
+	min, ok := levelSeverity[*f_min_level]
+	if !ok {
+		return true
+	}
+	sev, ok := levelSeverity[rec.level]
+	if !ok {
+		return true
+	}
+	return sev >= min
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestParseSyslog(t *testing.T) {
+	cases := []struct {
+		name      string
+		raw       string
+		wantText  string
+		wantLevel string
+	}{
+		{"valid pri", "<34>ok", "ok", "crit"},
+		{"negative pri", "<-1>test", "<-1>test", ""},
+		{"pri too large", "<300>other", "<300>other", ""},
+		{"non-numeric pri", "<abc>bad", "<abc>bad", ""},
+		{"no closing bracket", "<34notclosed", "<34notclosed", ""},
+		{"no opening bracket", "plain text", "plain text", ""},
+		{"too short", "<>", "<>", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			text, rec := parseSyslog(c.raw)
+			if text != c.wantText {
+				t.Errorf("text = %q, want %q", text, c.wantText)
+			}
+			if rec.level != c.wantLevel {
+				t.Errorf("level = %q, want %q", rec.level, c.wantLevel)
+			}
+		})
+	}
+}
+
+func TestParseKlog(t *testing.T) {
+	text, rec := parseKlog("I0726 09:33:03.123456 hello world")
+	if text != "hello world" {
+		t.Errorf("text = %q, want %q", text, "hello world")
+	}
+	if rec.level != "info" {
+		t.Errorf("level = %q, want %q", rec.level, "info")
+	}
+
+	text, rec = parseKlog("not a klog line")
+	if text != "not a klog line" {
+		t.Errorf("text = %q, want unchanged input", text)
+	}
+	if rec.level != "" {
+		t.Errorf("level = %q, want empty for unrecognized line", rec.level)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	text, rec := parseJSON(`{"msg":"jsonmsg","level":"warn","host":"originhost","pid":999}`)
+	if text != "jsonmsg" {
+		t.Errorf("text = %q, want %q", text, "jsonmsg")
+	}
+	if rec.level != "warn" {
+		t.Errorf("level = %q, want %q", rec.level, "warn")
+	}
+	if rec.extra["host"] != "originhost" {
+		t.Errorf("extra[host] = %v, want %q", rec.extra["host"], "originhost")
+	}
+
+	text, rec = parseJSON("not json")
+	if text != "not json" {
+		t.Errorf("text = %q, want unchanged input on parse failure", text)
+	}
+	if rec.extra != nil {
+		t.Errorf("extra = %v, want nil on parse failure", rec.extra)
+	}
+}
+
+func TestPassesMinLevel(t *testing.T) {
+	old := *f_min_level
+	defer func() { *f_min_level = old }()
+
+	*f_min_level = "warn"
+	if passesMinLevel(&logRecord{level: "info"}) {
+		t.Error("info should not pass -min-level=warn")
+	}
+	if !passesMinLevel(&logRecord{level: "error"}) {
+		t.Error("error should pass -min-level=warn")
+	}
+	if !passesMinLevel(&logRecord{level: ""}) {
+		t.Error("a record with no level should always pass")
+	}
+
+	*f_min_level = ""
+	if !passesMinLevel(&logRecord{level: "debug"}) {
+		t.Error("everything should pass when -min-level is unset")
+	}
+}
@@ -10,11 +10,11 @@ import (
 	"flag"
 	"log"
 	"fmt"
-	"net"
 	"io"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unicode/utf8"
@@ -24,6 +24,10 @@ import (
 type jsonAttrSet map[string]string
 var jsonAttrs = make(jsonAttrSet)
 
+// Exit code used when -shutdown-timeout expires with output still
+// unflushed, distinct from the exit(1) used for startup failures.
+const exitShutdownTimeout = 2
+
 // Define flags
 var f_logpath = flag.String("lp-logfile", "", "Path to the logpipe log")
 var f_socketpath = flag.String("socket", "", "Path to the log socket")
@@ -38,6 +42,52 @@ var f_init_reconnect = flag.Bool("retry-initial-connect", true,
 var f_esc_null = flag.Bool("escape-null", true,
 	"Escapes NULL characters in output as <NUL>")
 var f_output_mode = flag.String("output-mode", "line", "Output mode (line/json)")
+var f_spool_dir = flag.String("spool-dir", "",
+	"Directory used to spool output to disk while the socket is down")
+var f_spool_max_bytes = flag.Int64("spool-max-bytes", 0,
+	"Maximum total bytes to retain in the spool, 0 for unlimited")
+var f_spool_max_age = flag.Duration("spool-max-age", 0,
+	"Maximum age of spooled data before it is dropped, 0 for unlimited")
+var f_spool_fsync = flag.String("spool-fsync", fsyncInterval,
+	"Spool fsync policy (none/interval/always)")
+var f_shutdown_timeout = flag.Duration("shutdown-timeout", 5*time.Second,
+	"Maximum time to drain STDIN and flush pending output on SIGHUP/SIGINT/SIGTERM")
+
+// outputSpec is one -output sink: a destination URL plus its failover mode.
+type outputSpec struct {
+	url  string
+	mode string
+}
+
+// outputSpecList is the repeatable -output flag. Each value is a sink URL
+// (unix://, tcp://, udp://, syslog+tcp://, syslog+udp://, syslog+unix://,
+// redis://), optionally suffixed with ";mode=required" (the default) or
+// ";mode=best-effort".
+type outputSpecList []outputSpec
+
+var f_outputs outputSpecList
+
+func (l *outputSpecList) String() string {
+	var parts []string
+	for _, s := range *l {
+		parts = append(parts, s.url+";mode="+s.mode)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *outputSpecList) Set(value string) error {
+	mode := sinkRequired
+	rawurl := value
+	if idx := strings.LastIndex(value, ";mode="); idx >= 0 {
+		mode = value[idx+len(";mode="):]
+		rawurl = value[:idx]
+	}
+	if mode != sinkRequired && mode != sinkBestEffort {
+		log.Fatalf("-output '%s' mode must be %s or %s", value, sinkRequired, sinkBestEffort)
+	}
+	*l = append(*l, outputSpec{url: rawurl, mode: mode})
+	return nil
+}
 
 func (i *jsonAttrSet) String() string {
 	r, err := json.Marshal(*i)
@@ -66,42 +116,99 @@ func (i *jsonAttrSet) Set(value string) error {
 func main() {
 	flag.Var(&jsonAttrs, "json-attr", "One or more k=v pairs to include " +
 		"in output messages")
+	flag.Var(&levelMapFlag, "level-map", "Comma-separated raw=level pairs "+
+		"to normalize -input-format severities, e.g. I=info,W=warn,E=error")
+	flag.Var(&f_outputs, "output", "Output sink URL (unix://, tcp://, udp://, "+
+		"syslog+tcp://, syslog+udp://, syslog+unix://, redis://); may be "+
+		"repeated to fan out, append ;mode=best-effort to not stall on "+
+		"failure, append ?tls=true on a tcp-based sink for TLS")
 	flag.Parse()
 
-	// Log exit due to signals
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigs
-		log.Printf("Received signal %v", sig)
-		os.Exit(0)
-	}()
 
 	// Add PID to log
 	log.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
 
-	if *f_socketpath == "" {
-		log.Fatal("-socket is a required argument")
-	}
-
-	var socktype string
-	if *f_socket_type == "stream" {
-		socktype = "unix"
-	} else if *f_socket_type == "dgram" {
-		socktype = "unixgram"
-	} else {
-		log.Fatal("-socket-type must be stream or dgram")
+	// -socket/-socket-type are the legacy way to name a single UNIX-domain
+	// sink; translate them into a -output URL so ship() only ever deals with
+	// the outputSpec list. They're mutually exclusive with -output.
+	if len(f_outputs) == 0 {
+		if *f_socketpath == "" {
+			log.Fatal("-socket or -output is a required argument")
+		}
+		rawurl := "unix:" + *f_socketpath
+		switch *f_socket_type {
+		case "stream":
+		case "dgram":
+			rawurl += "?socktype=dgram"
+		default:
+			log.Fatal("-socket-type must be stream or dgram")
+		}
+		f_outputs = append(f_outputs, outputSpec{url: rawurl, mode: sinkRequired})
+	} else if *f_socketpath != "" {
+		log.Fatal("-socket cannot be combined with -output")
 	}
 
 	if *f_output_mode == "line" {
 		if len(jsonAttrs) > 0 {
 			log.Fatal("-json-attr cannot be specified unless -output-mode is json")
 		}
+		if *f_input_format != "line" || len(levelMapFlag) > 0 || *f_min_level != "" {
+			log.Fatal("-input-format, -level-map and -min-level require -output-mode=json")
+		}
 	} else if *f_output_mode == "json" {
 	} else {
 		log.Fatalf("-output-mode '%s' must be line or json", *f_output_mode)
 	}
 
+	switch *f_input_format {
+	case "line", "syslog", "klog", "json":
+	default:
+		log.Fatalf("-input-format '%s' must be line, syslog, klog or json", *f_input_format)
+	}
+
+	if *f_min_level != "" {
+		if _, ok := levelSeverity[*f_min_level]; !ok {
+			log.Fatalf("-min-level '%s' is not a recognized level", *f_min_level)
+		}
+	}
+
+	if *f_spool_dir != "" {
+		switch *f_spool_fsync {
+		case fsyncNone, fsyncInterval, fsyncAlways:
+		default:
+			log.Fatalf("-spool-fsync '%s' must be none, interval or always", *f_spool_fsync)
+		}
+		var err error
+		theSpool, err = newSpool(*f_spool_dir, *f_spool_max_bytes, *f_spool_max_age, *f_spool_fsync)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *f_spool_max_bytes != 0 || *f_spool_max_age != 0 {
+		log.Fatal("-spool-max-bytes and -spool-max-age require -spool-dir")
+	}
+
+	switch *f_rate_on_exhaustion {
+	case "block", "drop":
+	default:
+		log.Fatalf("-rate-on-exhaustion '%s' must be block or drop", *f_rate_on_exhaustion)
+	}
+	theRateLimiter = newRateLimiter(*f_rate_bytes_per_sec, *f_rate_messages_per_sec)
+
+	sharedTLSConfig = buildTLSConfig()
+	sharedAEAD = buildAEAD()
+
+	var err error
+	theOutput, err = newFanout(f_outputs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *f_stats_addr != "" {
+		startStatsServer(*f_stats_addr)
+	}
+
 	if *f_logpath != "" {
 		logfile, err := os.OpenFile(*f_logpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 		if err != nil {
@@ -114,7 +221,9 @@ func main() {
 		// Dump arguments
 		log.Printf("Opened lp-logfile %s", *f_logpath)
 		log.Printf("Options:")
-		log.Printf("\tsocket='%s' (%s)", *f_socketpath, *f_socket_type)
+		for _, spec := range f_outputs {
+			log.Printf("\toutput=%s (mode=%s)", spec.url, spec.mode)
+		}
 		log.Printf("\treconnect-time=%d", *f_reconnect_time)
 		log.Printf("\tretry-initial-connect=%v", *f_init_reconnect)
 		log.Printf("\tprefix='%s'", *f_prefix)
@@ -122,132 +231,284 @@ func main() {
 		log.Printf("\tescape-null=%v", *f_esc_null)
 		log.Printf("\toutput-mode=%s", *f_output_mode)
 		log.Printf("\tjson-attr=%s", jsonAttrs.String())
+		log.Printf("\tspool-dir='%s'", *f_spool_dir)
+		if *f_spool_dir != "" {
+			log.Printf("\tspool-max-bytes=%d", *f_spool_max_bytes)
+			log.Printf("\tspool-max-age=%v", *f_spool_max_age)
+			log.Printf("\tspool-fsync=%s", *f_spool_fsync)
+		}
+		log.Printf("\tshutdown-timeout=%v", *f_shutdown_timeout)
+		log.Printf("\tinput-format=%s", *f_input_format)
+		if *f_min_level != "" {
+			log.Printf("\tmin-level=%s", *f_min_level)
+		}
+		if len(levelMapFlag) > 0 {
+			log.Printf("\tlevel-map=%s", levelMapFlag.String())
+		}
+		log.Printf("\ttls-ca='%s'", *f_tls_ca)
+		log.Printf("\ttls-cert='%s'", *f_tls_cert)
+		log.Printf("\ttls-server-name='%s'", *f_tls_server_name)
+		log.Printf("\ttls-insecure-skip-verify=%v", *f_tls_insecure_skip_verify)
+		log.Printf("\tencrypt=%v", *f_encrypt_key != "")
+		log.Printf("\trate-bytes-per-sec=%d", *f_rate_bytes_per_sec)
+		log.Printf("\trate-messages-per-sec=%d", *f_rate_messages_per_sec)
+		if theRateLimiter != nil {
+			log.Printf("\trate-burst-timeout=%v", *f_rate_burst_timeout)
+			log.Printf("\trate-on-exhaustion=%s", *f_rate_on_exhaustion)
+		}
+		log.Printf("\tstats-addr='%s'", *f_stats_addr)
 	}
 
-	for {
-		run(*f_socketpath, socktype, *f_prefix)
-		if *f_reconnect_time > 0 {
-			log.Printf(
-				"Pausing %d seconds until reconnect", *f_reconnect_time)
-			time.Sleep(time.Duration(*f_reconnect_time) * time.Second)
-		} else {
-			// No reconnect: Bail with error
-			os.Exit(1)
+	// With no spool configured, STDIN is only ever read while a connection
+	// is held (see ship()), so the producer sees backpressure during an
+	// outage exactly as before. With a spool configured, produceStdin runs
+	// for the lifetime of the process and ship() drains lineCh into the
+	// spool whenever the socket is unavailable.
+	go produceStdin(*f_prefix)
+	go ship()
+
+	select {
+	case <-shipDone:
+		os.Exit(0)
+	case sig := <-sigs:
+		log.Printf("Received signal %v, draining STDIN (max %v)", sig, *f_shutdown_timeout)
+		// Stop accepting new input so produceStdin's blocked read returns
+		// and the reader/writer/spool get a chance to drain what's left.
+		atomic.StoreInt32(&shuttingDown, 1)
+		os.Stdin.Close()
+		select {
+		case <-shipDone:
+			log.Print("Flushed pending output before shutdown timeout")
+			os.Exit(0)
+		case <-time.After(*f_shutdown_timeout):
+			log.Printf("Shutdown timeout (%v) expired with output still unflushed", *f_shutdown_timeout)
+			os.Exit(exitShutdownTimeout)
 		}
 	}
 }
 
-var nr_conns = 0
-var strout string
+var theOutput *fanout
+var theSpool *spool
+var reader = bufio.NewReader(os.Stdin)
+var lineCh = make(chan string, 1)
 
-func makeOutString(instr string) string {
+// shipDone is closed once ship() has drained lineCh to completion (STDIN
+// hit EOF and every line has been written or spooled), so main() can
+// distinguish a clean exit from a shutdown-timeout exit.
+var shipDone = make(chan struct{})
+
+// shuttingDown is set right before main() closes os.Stdin on a shutdown
+// signal, so produceStdin knows the resulting read error is expected rather
+// than a real I/O failure.
+var shuttingDown int32
+
+// makeOutString formats a single (already wrapped/prefixed) chunk of text
+// for the wire. In line mode it's passed through unchanged; in json mode it
+// becomes the "message" field of an envelope built from rec, -json-attr,
+// and (for -input-format=json) the parsed input's own fields.
+func makeOutString(rec *logRecord, instr string) string {
 	if *f_output_mode == "line" {
 		return instr
-	} else {
-		jsonAttrs["message"] = instr
-		o, err := json.Marshal(jsonAttrs)
-		if err != nil {
-			log.Fatalf("json Marshal error: %v", err)
-		}
-		return string(o)
 	}
-}
 
-func run(socketpath string, sockettype string, prefix string) {
-	// Connect to UNIX-domain socket
-	conn, err := net.Dial(sockettype, socketpath)
+	env := make(map[string]interface{}, len(jsonAttrs)+len(rec.extra)+4)
+	for k, v := range rec.extra {
+		env[k] = v
+	}
+	env["ts"] = rec.ts.Format(time.RFC3339Nano)
+	if rec.level != "" {
+		env["level"] = rec.level
+	}
+	if _, ok := env["host"]; !ok {
+		env["host"] = hostname
+	}
+	if _, ok := env["pid"]; !ok {
+		env["pid"] = pid
+	}
+	if instr != "" {
+		env["message"] = instr
+	}
+	for k, v := range jsonAttrs {
+		env[k] = v
+	}
+
+	o, err := json.Marshal(env)
 	if err != nil {
-		log.Print("Connection failed: ", err.Error())
-		if nr_conns == 0 && !*f_init_reconnect {
-			// No successful connections have happened, so we haven't
-			// read anything from STDIN and we can safely exit now.
-			os.Exit(1)
-		} else {
-			return
-		}
+		log.Fatalf("json Marshal error: %v", err)
 	}
-	nr_conns++
-	log.Printf("Connected to socket %v (#%d)", socketpath, nr_conns)
+	return string(o)
+}
 
+// buildOutputLines formats a single parsed input line into one or more
+// newline-terminated output strings, applying the configured prefix and
+// -wrap width. Every chunk shares the same rec, since -wrap only splits one
+// logical message across several envelopes.
+func buildOutputLines(prefix string, stxt string, rec *logRecord) []string {
 	// Precompute prefix length. Include newline if we are in line output mode
 	var plen = len(prefix)
 	if *f_output_mode == "line" {
 		plen = plen + 1
 	}
 
-	reader := bufio.NewReader(os.Stdin)
-	writer := bufio.NewWriter(conn)
+	if *f_wrap == 0 || len(stxt)+plen < *f_wrap {
+		return []string{makeOutString(rec, prefix+stxt) + "\n"}
+	}
 
-	// Keep writing data
-	var readerErr error
+	// Wrap stxt, respecting UTF-8 rune boundaries
+	var lines []string
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	var lineBytes = plen
+
+	for _, runeValue := range stxt {
+		var runeBytes = utf8.RuneLen(runeValue)
+		if lineBytes+runeBytes > *f_wrap {
+			lines = append(lines, makeOutString(rec, sb.String())+"\n")
+			sb.Reset()
+			sb.WriteString(prefix)
+			lineBytes = plen
+		}
+		lineBytes += runeBytes
+		sb.WriteRune(runeValue)
+	}
+	lines = append(lines, makeOutString(rec, sb.String())+"\n")
+
+	return lines
+}
+
+// produceStdin reads STDIN to completion, parsing and formatting each line
+// and handing it to lineCh for ship() to deliver or spool. It never blocks
+// on the state of the socket.
+func produceStdin(prefix string) {
 	for {
-		// Build output string
-		if strout != "" {
-			// Write string to output buffer
-			_, err = writer.WriteString(strout)
-			if err != nil {
-				log.Print("Write failed: ", err.Error())
-				return
+		stxt, err := reader.ReadString('\n')
+		if len(stxt) >= 1 {
+			stxt = stxt[:len(stxt)-1]
+
+			// Escape NULLs in output string
+			if *f_esc_null {
+				stxt = strings.Replace(stxt, "\x00", "<NUL>", -1)
 			}
-			err = writer.Flush()
-			if err != nil {
-				log.Print("Flush failed: ", err.Error())
-				return
+
+			message, rec := parseInputLine(stxt)
+			if passesMinLevel(rec) {
+				for _, line := range buildOutputLines(prefix, message, rec) {
+					lineCh <- line
+				}
 			}
 		}
 
-		// If we didn't get any more data, exit the loop
-		var stxt string
-		stxt, readerErr = reader.ReadString('\n')
-		if len(stxt) < 1 {
-			break;
+		if err != nil {
+			if err != io.EOF && atomic.LoadInt32(&shuttingDown) == 0 {
+				log.Fatal(err)
+			}
+			break
+		}
+	}
+
+	close(lineCh)
+}
+
+// writeAndFlush delivers one formatted line to output, flushing immediately
+// so a partially-written line is never left sitting in a buffer.
+func writeAndFlush(output Output, line string) error {
+	if err := output.Write([]byte(line)); err != nil {
+		return err
+	}
+	return output.Flush()
+}
+
+// replaySpool replays any spooled backlog over theOutput; called once after
+// every sink reconnect attempt, whether triggered by spoolReconnectLoop or
+// by ship()'s startup connect.
+func replaySpool() {
+	if err := theSpool.Replay(func(line string) error {
+		return writeAndFlush(theOutput, line)
+	}); err != nil {
+		log.Print("Spool replay interrupted: ", err.Error())
+	}
+}
+
+// spoolReconnectLoop retries disconnected sinks in the background whenever a
+// spool is configured, so spooled data is replayed promptly even if STDIN
+// goes quiet during an outage. Without a spool, ship() retries inline
+// instead, preserving the original behavior of backing STDIN up while
+// disconnected.
+func spoolReconnectLoop() {
+	delay := time.Duration(*f_reconnect_time) * time.Second
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for {
+		time.Sleep(delay)
+		if theOutput.Reconnect() == nil {
+			replaySpool()
+		}
+	}
+}
+
+// ship owns the output sinks for the lifetime of the process. It consumes
+// lines from lineCh and either writes them straight through, or - while a
+// required sink is down - appends them to the spool (if configured) for
+// replay once it reconnects.
+func ship() {
+	if err := theOutput.Reconnect(); err != nil {
+		if !*f_init_reconnect {
+			// No successful connections have happened and the user asked
+			// not to retry, so we haven't read anything from STDIN yet and
+			// there's nothing to drain - bail immediately rather than going
+			// through the graceful-shutdown path.
+			os.Exit(1)
 		}
-		stxt = stxt[:len(stxt)-1]
+	} else if theSpool != nil {
+		replaySpool()
+	}
+
+	if theSpool != nil {
+		go spoolReconnectLoop()
+	}
 
-		// Escape NULLs in output string
-		if *f_esc_null {
-			stxt = strings.Replace(stxt, "\x00", "<NUL>", -1);
+	for line := range lineCh {
+		if theRateLimiter != nil {
+			timeout := *f_rate_burst_timeout
+			if *f_rate_on_exhaustion == "block" {
+				timeout = 0
+			}
+			if !theRateLimiter.Allow(len(line), timeout) {
+				atomic.AddInt64(&statMsgsDropped, 1)
+				atomic.AddInt64(&statBytesDropped, int64(len(line)))
+				log.Printf("Rate limit exceeded, dropping message (%d dropped so far)",
+					atomic.LoadInt64(&statMsgsDropped))
+				continue
+			}
 		}
 
-		if *f_wrap == 0 || len(stxt) + plen < *f_wrap {
-			// Queue data for writing
-			strout = makeOutString(prefix + stxt) + "\n"
-		} else {
-			// Prepare string builders
-			var sb strings.Builder
-			var ob strings.Builder
-			sb.WriteString(prefix)
-			var lineBytes = plen
-
-			// Wrap stxt, respecting UTF-8 rune boundaries
-			for _, runeValue := range stxt {
-				var runeBytes = utf8.RuneLen(runeValue)
-				if lineBytes + runeBytes > *f_wrap {
-					ostr := makeOutString(sb.String())
-					ob.WriteString(ostr)
-					ob.WriteString("\n")
-					sb.Reset()
-					sb.WriteString(prefix)
-					lineBytes = plen
+		for {
+			if err := writeAndFlush(theOutput, line); err == nil {
+				atomic.AddInt64(&statBytesWritten, int64(len(line)))
+				break
+			}
+
+			if theSpool != nil {
+				// Background spoolReconnectLoop owns reconnection; just
+				// buffer this line and move on to the next one so STDIN
+				// never stalls.
+				if err := theSpool.Write(line); err != nil {
+					log.Fatalf("spool write failed: %v", err)
 				}
-				lineBytes += runeBytes
-				sb.WriteRune(runeValue)
+				break
 			}
-			ostr := makeOutString(sb.String())
-			ob.WriteString(ostr)
-			ob.WriteString("\n")
 
-			// Flush string
-			strout = ob.String()
+			if *f_reconnect_time <= 0 {
+				os.Exit(1)
+			}
+			log.Printf("Pausing %d seconds until reconnect", *f_reconnect_time)
+			time.Sleep(time.Duration(*f_reconnect_time) * time.Second)
+			theOutput.Reconnect()
 		}
 	}
 
-	if readerErr != nil && readerErr != io.EOF {
-		log.Fatal(err)
-	}
-
-	// On EOF, we just bail...
 	log.Print("Reached EOF on STDIN")
-	os.Exit(0)
+	close(shipDone)
 }
 
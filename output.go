@@ -0,0 +1,479 @@
+/* ======================================================================== */
+/* output.go - pluggable output sinks, with fan-out and per-sink failover   */
+/* ======================================================================== */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Output is a single destination logpipe can ship lines to. Reconnect is
+// called both for the first connection attempt and for every subsequent
+// retry; Write/Flush are expected to fail once the underlying connection
+// has dropped, so the caller can call Reconnect again.
+type Output interface {
+	Write([]byte) error
+	Flush() error
+	Close() error
+	Reconnect() error
+}
+
+// connOutput is a net.Conn-backed Output, used for unix, unixgram, tcp and
+// udp sinks alike - net.Dial already treats all four uniformly. tlsConfig is
+// non-nil only for tcp sinks opted into TLS via ?tls=true.
+type connOutput struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	conn      net.Conn
+	writer    *bufio.Writer
+}
+
+func newConnOutput(network string, address string, tlsConfig *tls.Config) *connOutput {
+	return &connOutput{network: network, address: address, tlsConfig: tlsConfig}
+}
+
+func (o *connOutput) Reconnect() error {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+	conn, err := tlsDial(o.network, o.address, o.tlsConfig)
+	if err != nil {
+		return err
+	}
+	o.conn = conn
+	o.writer = bufio.NewWriter(conn)
+	return nil
+}
+
+func (o *connOutput) Write(p []byte) error {
+	if o.conn == nil {
+		return fmt.Errorf("%s://%s: not connected", o.network, o.address)
+	}
+	_, err := o.writer.Write(p)
+	return err
+}
+
+func (o *connOutput) Flush() error {
+	if o.conn == nil {
+		return fmt.Errorf("%s://%s: not connected", o.network, o.address)
+	}
+	return o.writer.Flush()
+}
+
+func (o *connOutput) Close() error {
+	if o.conn == nil {
+		return nil
+	}
+	err := o.conn.Close()
+	o.conn = nil
+	o.writer = nil
+	return err
+}
+
+// syslogOutput wraps an inner Output with RFC 5424 octet-counting framing.
+// Stream transports (tcp, unix stream) need framing so the receiver can
+// resync message boundaries after packet loss; datagram transports (udp,
+// unixgram) already deliver one message per packet, so framing is skipped.
+type syslogOutput struct {
+	inner  Output
+	framed bool
+}
+
+func (o *syslogOutput) Reconnect() error { return o.inner.Reconnect() }
+func (o *syslogOutput) Close() error     { return o.inner.Close() }
+func (o *syslogOutput) Flush() error     { return o.inner.Flush() }
+
+func (o *syslogOutput) Write(p []byte) error {
+	msg := bytes.TrimSuffix(p, []byte("\n"))
+	if !o.framed {
+		return o.inner.Write(msg)
+	}
+	framed := append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	return o.inner.Write(framed)
+}
+
+// redisOutput ships each line as a RESP RPUSH (list) or PUBLISH (pub/sub)
+// command, addressed as redis://host:port/db?key=logs or ?channel=logs.
+type redisOutput struct {
+	address   string
+	db        int
+	key       string
+	channel   string
+	tlsConfig *tls.Config
+	conn      net.Conn
+	writer    *bufio.Writer
+	reader    *bufio.Reader
+}
+
+func (o *redisOutput) Reconnect() error {
+	if o.conn != nil {
+		o.conn.Close()
+		o.conn = nil
+	}
+	conn, err := tlsDial("tcp", o.address, o.tlsConfig)
+	if err != nil {
+		return err
+	}
+	o.conn = conn
+	o.writer = bufio.NewWriter(conn)
+	o.reader = bufio.NewReader(conn)
+
+	if o.db != 0 {
+		if err := o.command("SELECT", strconv.Itoa(o.db)); err != nil {
+			conn.Close()
+			o.conn = nil
+			return fmt.Errorf("SELECT %d: %v", o.db, err)
+		}
+	}
+	return nil
+}
+
+// command issues a RESP array command and reads back one reply line,
+// returning an error if Redis answered with a "-ERR ..." reply.
+func (o *redisOutput) command(args ...string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := o.writer.Write(b.Bytes()); err != nil {
+		return err
+	}
+	if err := o.writer.Flush(); err != nil {
+		return err
+	}
+	reply, err := o.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(reply, "-") {
+		return fmt.Errorf("redis error: %s", strings.TrimSpace(reply[1:]))
+	}
+	return nil
+}
+
+func (o *redisOutput) Write(p []byte) error {
+	if o.conn == nil {
+		return fmt.Errorf("redis %s: not connected", o.address)
+	}
+	msg := strings.TrimSuffix(string(p), "\n")
+	if o.channel != "" {
+		return o.command("PUBLISH", o.channel, msg)
+	}
+	return o.command("RPUSH", o.key, msg)
+}
+
+// Flush is a no-op: command() already flushes each RESP command as it's
+// issued, since every line is its own round trip.
+func (o *redisOutput) Flush() error { return nil }
+
+func (o *redisOutput) Close() error {
+	if o.conn == nil {
+		return nil
+	}
+	err := o.conn.Close()
+	o.conn = nil
+	o.writer = nil
+	o.reader = nil
+	return err
+}
+
+// dialOutputFromURL builds the (not-yet-connected) Output for one -output
+// URL. Supported schemes: unix, tcp, udp, syslog+tcp, syslog+udp,
+// syslog+unix, redis. tcp-based schemes honor ?tls=true; the result is
+// wrapped in encryption if -encrypt-key is set, regardless of scheme.
+func dialOutputFromURL(rawurl string) (Output, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output URL %q: %v", rawurl, err)
+	}
+
+	var out Output
+
+	switch u.Scheme {
+	case "unix":
+		out = newConnOutput(unixNetwork(u), unixPath(u), nil)
+
+	case "tcp":
+		out = newConnOutput("tcp", u.Host, tlsConfigFor(u))
+
+	case "udp":
+		out = newConnOutput("udp", u.Host, nil)
+
+	case "syslog+tcp", "syslog+udp", "syslog+unix":
+		transport := strings.TrimPrefix(u.Scheme, "syslog+")
+		var inner Output
+		framed := true
+		switch transport {
+		case "tcp":
+			inner = newConnOutput("tcp", u.Host, tlsConfigFor(u))
+		case "udp":
+			inner = newConnOutput("udp", u.Host, nil)
+			framed = false
+		case "unix":
+			network := unixNetwork(u)
+			inner = newConnOutput(network, unixPath(u), nil)
+			framed = network != "unixgram"
+		}
+		out = &syslogOutput{inner: inner, framed: framed}
+
+	case "redis":
+		q := u.Query()
+		key := q.Get("key")
+		channel := q.Get("channel")
+		if key == "" && channel == "" {
+			return nil, fmt.Errorf("redis output %q needs a ?key= or ?channel= query parameter", rawurl)
+		}
+		db := 0
+		if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+			db, err = strconv.Atoi(path)
+			if err != nil {
+				return nil, fmt.Errorf("redis output %q has a non-numeric db %q", rawurl, path)
+			}
+		}
+		address := u.Host
+		if !strings.Contains(address, ":") {
+			address += ":6379"
+		}
+		out = &redisOutput{address: address, db: db, key: key, channel: channel, tlsConfig: tlsConfigFor(u)}
+
+	default:
+		return nil, fmt.Errorf("unsupported output scheme %q in %q", u.Scheme, rawurl)
+	}
+
+	if sharedAEAD != nil {
+		out = &encryptOutput{inner: out, aead: sharedAEAD}
+	}
+	return out, nil
+}
+
+// tlsConfigFor returns a copy of sharedTLSConfig if u opted into TLS via
+// ?tls=true, else nil. ServerName defaults to u's host when -tls-server-name
+// wasn't given, since tls.Client otherwise refuses to handshake at all
+// without either ServerName or InsecureSkipVerify set, and the point of
+// putting the host in the -output URL is not having to repeat it.
+func tlsConfigFor(u *url.URL) *tls.Config {
+	if u.Query().Get("tls") != "true" {
+		return nil
+	}
+	cfg := sharedTLSConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	return cfg
+}
+
+func unixNetwork(u *url.URL) string {
+	if u.Query().Get("socktype") == "dgram" {
+		return "unixgram"
+	}
+	return "unix"
+}
+
+func unixPath(u *url.URL) string {
+	if u.Path != "" {
+		return u.Path
+	}
+	return u.Opaque
+}
+
+// sinkEntry pairs a dialed Output with its failover mode and reconnect
+// pacing, so a down best-effort sink doesn't get redialed on every line.
+type sinkEntry struct {
+	url       string
+	mode      string
+	out       Output
+	connected bool
+	nextRetry time.Time
+}
+
+const (
+	sinkRequired   = "required"
+	sinkBestEffort = "best-effort"
+)
+
+func (s *sinkEntry) ensure() error {
+	if s.connected {
+		return nil
+	}
+	if time.Now().Before(s.nextRetry) {
+		return fmt.Errorf("%s: waiting to retry", s.url)
+	}
+	if err := s.out.Reconnect(); err != nil {
+		s.backoff()
+		log.Printf("Output %s connection failed: %v", s.url, err)
+		return err
+	}
+	s.connected = true
+	atomic.AddInt64(&statReconnects, 1)
+	log.Printf("Output %s connected", s.url)
+	return nil
+}
+
+func (s *sinkEntry) fail(err error) {
+	log.Printf("Output %s failed: %v", s.url, err)
+	s.out.Close()
+	s.connected = false
+	s.backoff()
+}
+
+func (s *sinkEntry) backoff() {
+	delay := time.Duration(*f_reconnect_time) * time.Second
+	if delay <= 0 {
+		delay = time.Second
+	}
+	s.nextRetry = time.Now().Add(delay)
+}
+
+// fanout is the top-level Output ship() writes to: one or more sinks, each
+// with its own failover mode. A required sink that's down or fails makes
+// Write/Flush return an error (so ship() spools or stalls); a best-effort
+// sink that's down is silently skipped until it reconnects on its own.
+//
+// mu serializes all access to sinks: ship()'s own goroutine and the
+// background spoolReconnectLoop() goroutine both call into a fanout
+// concurrently (Write/Flush from ship(), Reconnect/replay-driven Write from
+// the reconnect loop), and sinkEntry/connOutput state isn't safe for
+// unsynchronized concurrent use.
+//
+// pendingLine/owed remember, for the one line that didn't reach every
+// required sink on its last Write, which required sinks still owe it. A
+// Write matching pendingLine - ship() and spool replay both retry a failed
+// line by calling Write again with the exact same bytes - only re-attempts
+// the sinks still in owed, so a required sink that already has the line
+// doesn't receive it again. Every other, fresh line first confirms all
+// required sinks are reachable before writing to any of them (see Write),
+// so at most one line can ever be outstanding like this at a time: once a
+// sink's mid-write failure puts it in owed, that same failure also marks
+// it disconnected, which blocks every later fresh line at the reachability
+// check until it reconnects and this one is resolved. The one gap this
+// doesn't close is a fresh line that happens to be byte-identical to the
+// one still owed; that's a rare, narrow miss, not the unconditional
+// duplication this replaces.
+type fanout struct {
+	mu    sync.Mutex
+	sinks []*sinkEntry
+
+	pendingLine []byte
+	owed        map[*sinkEntry]bool
+}
+
+func newFanout(specs []outputSpec) (*fanout, error) {
+	f := &fanout{}
+	for _, spec := range specs {
+		out, err := dialOutputFromURL(spec.url)
+		if err != nil {
+			return nil, err
+		}
+		f.sinks = append(f.sinks, &sinkEntry{url: spec.url, mode: spec.mode, out: out})
+	}
+	return f, nil
+}
+
+// Write delivers p to every sink. Unless p is a retry of the one
+// outstanding pendingLine, it first confirms every required sink is
+// reachable before writing to any of them, so a sink already known down
+// can't leave an earlier sink in f.sinks holding a delivery that gets
+// duplicated once the down sink recovers and the line is retried. A sink
+// that looks reachable but fails its Write/Flush right here - discovered
+// only during this call, not by the reachability check - is recorded in
+// pendingLine/owed instead, so that specific retry only goes to the sinks
+// that still need it.
+func (f *fanout) Write(p []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	retry := f.owed != nil && bytes.Equal(f.pendingLine, p)
+
+	if !retry {
+		for _, s := range f.sinks {
+			if err := s.ensure(); err != nil && s.mode == sinkRequired {
+				return err
+			}
+		}
+	}
+
+	var requiredErr error
+	stillOwed := map[*sinkEntry]bool{}
+	for _, s := range f.sinks {
+		if retry && s.mode == sinkRequired && !f.owed[s] {
+			continue
+		}
+		if err := s.ensure(); err != nil {
+			if s.mode == sinkRequired {
+				requiredErr = err
+				stillOwed[s] = true
+			}
+			continue
+		}
+		if err := s.out.Write(p); err != nil {
+			s.fail(err)
+			if s.mode == sinkRequired {
+				requiredErr = err
+				stillOwed[s] = true
+			}
+			continue
+		}
+		if err := s.out.Flush(); err != nil {
+			s.fail(err)
+			if s.mode == sinkRequired {
+				requiredErr = err
+				stillOwed[s] = true
+			}
+		}
+	}
+
+	if requiredErr != nil {
+		f.pendingLine = p
+		f.owed = stillOwed
+	} else if retry {
+		f.pendingLine = nil
+		f.owed = nil
+	}
+	return requiredErr
+}
+
+// Flush is a no-op: Write already flushes each sink as it writes to it.
+func (f *fanout) Flush() error { return nil }
+
+func (f *fanout) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, s := range f.sinks {
+		s.out.Close()
+		s.connected = false
+	}
+	f.pendingLine = nil
+	f.owed = nil
+	return nil
+}
+
+// Reconnect retries every disconnected sink (subject to its own backoff)
+// and reports an error if any required sink is still down afterward.
+func (f *fanout) Reconnect() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var requiredErr error
+	for _, s := range f.sinks {
+		if err := s.ensure(); err != nil && s.mode == sinkRequired {
+			requiredErr = err
+		}
+	}
+	return requiredErr
+}
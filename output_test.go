@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// fakeOutput is an in-memory Output for exercising fanout without real
+// sockets. failNextWrite/failNextFlush consume themselves on the next call.
+type fakeOutput struct {
+	lines         []string
+	failNextWrite bool
+	failNextFlush bool
+	reconnectErr  error
+}
+
+func (f *fakeOutput) Write(p []byte) error {
+	if f.failNextWrite {
+		f.failNextWrite = false
+		return fmt.Errorf("fakeOutput: write failed")
+	}
+	f.lines = append(f.lines, string(p))
+	return nil
+}
+
+func (f *fakeOutput) Flush() error {
+	if f.failNextFlush {
+		f.failNextFlush = false
+		return fmt.Errorf("fakeOutput: flush failed")
+	}
+	return nil
+}
+
+func (f *fakeOutput) Close() error     { return nil }
+func (f *fakeOutput) Reconnect() error { return f.reconnectErr }
+
+func connectedSink(url string, mode string, out Output) *sinkEntry {
+	return &sinkEntry{url: url, mode: mode, out: out, connected: true}
+}
+
+// TestFanoutRetryDoesNotDuplicateMidWriteFailure covers the chunk0-4 fix: a
+// required sink that fails its Write/Flush mid-call, after an earlier sink
+// already wrote and flushed the same line, must not receive that line again
+// once the caller retries it (ship()'s retry loop and spool replay both
+// retry a failed line by calling Write again with the same bytes).
+func TestFanoutRetryDoesNotDuplicateMidWriteFailure(t *testing.T) {
+	a := &fakeOutput{}
+	b := &fakeOutput{}
+	f := &fanout{sinks: []*sinkEntry{
+		connectedSink("tcp://a", sinkRequired, a),
+		connectedSink("tcp://b", sinkRequired, b),
+	}}
+
+	if err := f.Write([]byte("line1\n")); err != nil {
+		t.Fatalf("line1: unexpected error: %v", err)
+	}
+
+	b.failNextWrite = true
+	if err := f.Write([]byte("line2\n")); err == nil {
+		t.Fatal("line2: expected an error from b's failed write")
+	}
+
+	// b is still down; the retry (same bytes) must not redeliver to a.
+	if err := f.Write([]byte("line2\n")); err == nil {
+		t.Fatal("retry of line2 while b is still down: expected an error")
+	}
+
+	// b recovers; the retry now succeeds and should reach only b, not a again.
+	f.sinks[1].connected = true
+	if err := f.Write([]byte("line2\n")); err != nil {
+		t.Fatalf("retry of line2 after b recovers: unexpected error: %v", err)
+	}
+
+	wantA := []string{"line1\n", "line2\n"}
+	wantB := []string{"line1\n", "line2\n"}
+	if !equalStrings(a.lines, wantA) {
+		t.Errorf("a received %v, want %v (line2 must not be duplicated on the retries)", a.lines, wantA)
+	}
+	if !equalStrings(b.lines, wantB) {
+		t.Errorf("b received %v, want %v", b.lines, wantB)
+	}
+}
+
+// TestFanoutPreCheckBlocksFreshLineWhileSinkDown covers the chunk0-4
+// pre-check: once a required sink is known down, a later, different line
+// must not be partially delivered to other sinks either.
+func TestFanoutPreCheckBlocksFreshLineWhileSinkDown(t *testing.T) {
+	a := &fakeOutput{}
+	b := &fakeOutput{}
+	f := &fanout{sinks: []*sinkEntry{
+		connectedSink("tcp://a", sinkRequired, a),
+		connectedSink("tcp://b", sinkRequired, b),
+	}}
+
+	f.sinks[1].connected = false
+	b.reconnectErr = fmt.Errorf("b: connection refused")
+
+	if err := f.Write([]byte("line1\n")); err == nil {
+		t.Fatal("expected an error while b is down")
+	}
+	if len(a.lines) != 0 {
+		t.Errorf("a received %v, want nothing: a fresh line must not be written to any sink until all required sinks are reachable", a.lines)
+	}
+}
+
+// TestFanoutBestEffortSinkDoesNotBlockDelivery covers the documented
+// best-effort behavior: a down best-effort sink is skipped, not retried
+// forever, and doesn't stop required sinks from receiving the line.
+func TestFanoutBestEffortSinkDoesNotBlockDelivery(t *testing.T) {
+	a := &fakeOutput{}
+	best := &fakeOutput{}
+	f := &fanout{sinks: []*sinkEntry{
+		connectedSink("tcp://a", sinkRequired, a),
+		connectedSink("tcp://best", sinkBestEffort, best),
+	}}
+	f.sinks[1].connected = false
+	best.reconnectErr = fmt.Errorf("best: connection refused")
+
+	if err := f.Write([]byte("line1\n")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !equalStrings(a.lines, []string{"line1\n"}) {
+		t.Errorf("a received %v, want [line1]", a.lines)
+	}
+	if len(best.lines) != 0 {
+		t.Errorf("best received %v, want nothing while down", best.lines)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+/* ======================================================================== */
+/* rate.go - token-bucket throttling of output bytes/sec and messages/sec   */
+/* ======================================================================== */
+
+package main
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+var f_rate_bytes_per_sec = flag.Int64("rate-bytes-per-sec", 0,
+	"Maximum output bytes per second, 0 for unlimited")
+var f_rate_messages_per_sec = flag.Int64("rate-messages-per-sec", 0,
+	"Maximum output messages per second, 0 for unlimited")
+var f_rate_burst_timeout = flag.Duration("rate-burst-timeout", 5*time.Second,
+	"Maximum time to wait for rate-limit tokens before honoring -rate-on-exhaustion")
+var f_rate_on_exhaustion = flag.String("rate-on-exhaustion", "block",
+	"What to do once -rate-burst-timeout expires with no tokens available (block/drop)")
+
+// theRateLimiter is non-nil once either -rate-bytes-per-sec or
+// -rate-messages-per-sec is set.
+var theRateLimiter *rateLimiter
+
+// tokenBucket refills at rate tokens/sec up to a one-second burst capacity.
+// A rate of 0 disables the bucket, so take() always succeeds immediately.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take blocks until n tokens are available or deadline passes, returning
+// false in the latter case. If forever is true, deadline is ignored and
+// take blocks until tokens are available. Capacity is normally one second's
+// worth of tokens, but a single request larger than that (e.g. one long
+// line under a low -rate-bytes-per-sec) is allowed to accumulate up to its
+// own size instead of being permanently unservable.
+func (b *tokenBucket) take(n float64, deadline time.Time, forever bool) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	capacity := b.rate
+	if n > capacity {
+		capacity = n
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > capacity {
+			b.tokens = capacity
+		}
+		b.last = now
+		if b.tokens >= n {
+			b.tokens -= n
+			b.mu.Unlock()
+			return true
+		}
+		b.mu.Unlock()
+
+		if !forever && now.After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rateLimiter gates one outbound line through independent byte-rate and
+// message-rate buckets, both measured against the same deadline.
+type rateLimiter struct {
+	bytes *tokenBucket
+	msgs  *tokenBucket
+}
+
+// newRateLimiter returns nil if both rates are unset, so callers can skip
+// the check entirely in the common unthrottled case.
+func newRateLimiter(bytesPerSec int64, msgsPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 && msgsPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		bytes: newTokenBucket(float64(bytesPerSec)),
+		msgs:  newTokenBucket(float64(msgsPerSec)),
+	}
+}
+
+// Allow blocks until a line of n bytes may be sent, waiting up to timeout
+// (or indefinitely if timeout <= 0). It reports whether the line may be
+// sent; false means the caller should honor -rate-on-exhaustion.
+func (r *rateLimiter) Allow(n int, timeout time.Duration) bool {
+	forever := timeout <= 0
+	deadline := time.Now().Add(timeout)
+	if !r.bytes.take(float64(n), deadline, forever) {
+		return false
+	}
+	return r.msgs.take(1, deadline, forever)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	b := newTokenBucket(0)
+	if !b.take(1e9, time.Now(), false) {
+		t.Error("a zero-rate bucket should never block")
+	}
+}
+
+func TestTokenBucketDrainAndRefill(t *testing.T) {
+	b := newTokenBucket(10)
+
+	if !b.take(10, time.Now().Add(time.Second), false) {
+		t.Fatal("expected the initial burst of 10 tokens to be available")
+	}
+	if b.take(1, time.Now(), false) {
+		t.Error("bucket should be empty right after draining its burst")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !b.take(1, time.Now().Add(time.Second), false) {
+		t.Error("expected a token to have refilled after waiting")
+	}
+}
+
+func TestTokenBucketDeadlineExpires(t *testing.T) {
+	b := newTokenBucket(1)
+	b.take(1, time.Now(), false)
+
+	start := time.Now()
+	if b.take(1, start.Add(20*time.Millisecond), false) {
+		t.Error("take should fail once the deadline passes with no tokens available")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("take should not block substantially past its deadline")
+	}
+}
+
+// TestTokenBucketOversizedRequest covers the chunk0-6 fix: a single request
+// larger than the bucket's rate must still eventually succeed by growing
+// capacity to its own size, instead of being permanently unservable.
+func TestTokenBucketOversizedRequest(t *testing.T) {
+	b := newTokenBucket(10)
+
+	done := make(chan bool, 1)
+	go func() { done <- b.take(50, time.Time{}, true) }()
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("take with forever=true should eventually return true")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("take never returned for an oversized request; capacity did not grow to n")
+	}
+}
+
+func TestRateLimiterNilWhenUnset(t *testing.T) {
+	if newRateLimiter(0, 0) != nil {
+		t.Error("newRateLimiter(0, 0) should return nil so callers can skip the check")
+	}
+	if newRateLimiter(100, 0) == nil {
+		t.Error("newRateLimiter should be non-nil when only bytes-per-sec is set")
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	r := newRateLimiter(1000, 1000)
+	if !r.Allow(10, time.Second) {
+		t.Error("a small line well within the burst should be allowed immediately")
+	}
+}
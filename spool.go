@@ -0,0 +1,273 @@
+/* ======================================================================== */
+/* spool.go - on-disk spool used to buffer output while the socket is down  */
+/* ======================================================================== */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Valid values for -spool-fsync.
+const (
+	fsyncNone     = "none"
+	fsyncInterval = "interval"
+	fsyncAlways   = "always"
+)
+
+// How often the background fsync goroutine flushes the active segment when
+// -spool-fsync=interval.
+const spoolFsyncInterval = time.Second
+
+// spool persists formatted output lines to disk while the socket is
+// unreachable, and replays them in order once a connection is
+// reestablished. Segments are named by the Unix nanosecond timestamp at
+// which they were created, so a lexical directory listing is also replay
+// order. A segment is only deleted once every line in it has been
+// acknowledged by the caller (normally after writer.Flush() succeeds), so a
+// crash mid-outage leaves the segment on disk to be replayed on the next
+// run.
+type spool struct {
+	dir         string
+	maxBytes    int64
+	maxAge      time.Duration
+	fsyncPolicy string
+
+	mu        sync.Mutex
+	curFile   *os.File
+	curWriter *bufio.Writer
+	curName   string
+}
+
+func newSpool(dir string, maxBytes int64, maxAge time.Duration, fsyncPolicy string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("spool: cannot create -spool-dir %s: %v", dir, err)
+	}
+
+	s := &spool{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		maxAge:      maxAge,
+		fsyncPolicy: fsyncPolicy,
+	}
+
+	if fsyncPolicy == fsyncInterval {
+		go s.fsyncLoop()
+	}
+
+	return s, nil
+}
+
+func (s *spool) fsyncLoop() {
+	for {
+		time.Sleep(spoolFsyncInterval)
+		s.mu.Lock()
+		if s.curFile != nil {
+			s.curWriter.Flush()
+			s.curFile.Sync()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// segmentPath returns the path for a freshly rotated-in segment file.
+func (s *spool) segmentPath() string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.seg", time.Now().UnixNano()))
+}
+
+// Write appends a single already-formatted output line (including its
+// trailing newline) to the active segment, opening a new one if needed.
+func (s *spool) Write(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.curFile == nil {
+		name := s.segmentPath()
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		s.curFile = f
+		s.curWriter = bufio.NewWriter(f)
+		s.curName = name
+	}
+
+	if _, err := s.curWriter.WriteString(line); err != nil {
+		return err
+	}
+
+	if s.fsyncPolicy == fsyncAlways {
+		if err := s.curWriter.Flush(); err != nil {
+			return err
+		}
+		if err := s.curFile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.enforceLimits()
+	return nil
+}
+
+// rotate closes the active segment (without deleting it) so it is picked up
+// by the next call to segments(), e.g. before a replay pass.
+func (s *spool) rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.curFile != nil {
+		s.curWriter.Flush()
+		s.curFile.Close()
+		s.curFile = nil
+		s.curWriter = nil
+		s.curName = ""
+	}
+}
+
+// segments lists spool segment files on disk, oldest first.
+func (s *spool) segments() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".seg") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func segmentTimestamp(name string) (time.Time, error) {
+	ns, err := strconv.ParseInt(strings.TrimSuffix(name, ".seg"), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ns), nil
+}
+
+// enforceLimits drops the oldest spool segments once -spool-max-age or
+// -spool-max-bytes is exceeded. Callers hold s.mu.
+func (s *spool) enforceLimits() {
+	if s.maxBytes <= 0 && s.maxAge <= 0 {
+		return
+	}
+
+	names, err := s.segments()
+	if err != nil {
+		return
+	}
+
+	if s.maxAge > 0 {
+		cutoff := time.Now().Add(-s.maxAge)
+		for len(names) > 0 {
+			name := names[0]
+			if name == filepath.Base(s.curName) {
+				break
+			}
+			ts, err := segmentTimestamp(name)
+			if err != nil || ts.After(cutoff) {
+				break
+			}
+			log.Printf("spool: dropping segment %s, older than -spool-max-age", name)
+			os.Remove(filepath.Join(s.dir, name))
+			names = names[1:]
+		}
+	}
+
+	if s.maxBytes > 0 {
+		var total int64
+		for _, name := range names {
+			if fi, err := os.Stat(filepath.Join(s.dir, name)); err == nil {
+				total += fi.Size()
+			}
+		}
+		for total > s.maxBytes && len(names) > 0 {
+			name := names[0]
+			if name == filepath.Base(s.curName) {
+				break
+			}
+			path := filepath.Join(s.dir, name)
+			if fi, err := os.Stat(path); err == nil {
+				total -= fi.Size()
+			}
+			log.Printf("spool: dropping oldest segment %s to honor -spool-max-bytes", name)
+			os.Remove(path)
+			names = names[1:]
+		}
+	}
+}
+
+// Bytes returns the total size in bytes of every segment currently on
+// disk, including the active one.
+func (s *spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names, err := s.segments()
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, name := range names {
+		if fi, err := os.Stat(filepath.Join(s.dir, name)); err == nil {
+			total += fi.Size()
+		}
+	}
+	return total
+}
+
+// Replay sends every spooled line, oldest segment first, to send. A
+// segment's bytes are deleted only once send has returned nil for every
+// line in it; a failure partway through a segment stops the replay so the
+// remaining lines are retried on the next call.
+func (s *spool) Replay(send func(line string) error) error {
+	s.rotate()
+
+	names, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.replaySegment(filepath.Join(s.dir, name), send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *spool) replaySegment(path string, send func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if len(line) > 0 {
+			if sendErr := send(line); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	return os.Remove(path)
+}
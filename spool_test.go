@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSpoolWriteAndReplayOrder(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 0, 0, fsyncNone)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		if err := s.Write(line); err != nil {
+			t.Fatalf("Write(%q): %v", line, err)
+		}
+	}
+
+	var got []string
+	if err := s.Replay(func(line string) error {
+		got = append(got, line)
+		return nil
+	}); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	want := []string{"one\n", "two\n", "three\n"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	if n := s.Bytes(); n != 0 {
+		t.Errorf("Bytes() after a fully successful replay = %d, want 0", n)
+	}
+}
+
+// TestSpoolReplayStopsOnFailure covers the "crash mid-outage" guarantee: a
+// segment is only deleted once every line in it has been sent successfully,
+// so a failure partway through leaves the remaining lines for the next call.
+func TestSpoolReplayStopsOnFailure(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 0, 0, fsyncNone)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+
+	for _, line := range []string{"one\n", "two\n", "three\n"} {
+		if err := s.Write(line); err != nil {
+			t.Fatalf("Write(%q): %v", line, err)
+		}
+	}
+
+	var sent []string
+	replayErr := s.Replay(func(line string) error {
+		sent = append(sent, line)
+		if line == "two\n" {
+			return errBoom
+		}
+		return nil
+	})
+	if replayErr != errBoom {
+		t.Fatalf("Replay error = %v, want errBoom", replayErr)
+	}
+	if len(sent) != 2 {
+		t.Fatalf("sent = %v, want exactly [one two]", sent)
+	}
+
+	if n := s.Bytes(); n == 0 {
+		t.Error("a segment with an unacknowledged line should still be on disk")
+	}
+
+	sent = nil
+	if err := s.Replay(func(line string) error {
+		sent = append(sent, line)
+		return nil
+	}); err != nil {
+		t.Fatalf("second Replay: %v", err)
+	}
+	want := []string{"one\n", "two\n", "three\n"}
+	if len(sent) != len(want) {
+		t.Fatalf("retried replay sent = %v, want %v", sent, want)
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Errorf("retried line %d = %q, want %q", i, sent[i], want[i])
+		}
+	}
+}
+
+func TestSpoolEnforceMaxBytesDropsOldest(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSpool(dir, 0, 0, fsyncNone)
+	if err != nil {
+		t.Fatalf("newSpool: %v", err)
+	}
+
+	s.Write("aaaaaaaaaa\n")
+	s.rotate()
+	time.Sleep(time.Millisecond)
+	s.maxBytes = 1
+	if err := s.Write("b\n"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	names, err := s.segments()
+	if err != nil {
+		t.Fatalf("segments: %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("segments = %v, want exactly the newest one left after -spool-max-bytes", names)
+	}
+}
+
+// errBoom is a sentinel error used to simulate a send failure partway
+// through a replay.
+type errBoomType struct{}
+
+func (errBoomType) Error() string { return "boom" }
+
+var errBoom = errBoomType{}
@@ -0,0 +1,76 @@
+/* ======================================================================== */
+/* stats.go - optional HTTP endpoint exposing runtime counters              */
+/* ======================================================================== */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+var f_stats_addr = flag.String("stats-addr", "",
+	"Address to serve JSON/Prometheus stats on (e.g. :9090), disabled if empty")
+
+// Counters updated from ship() and the output sinks; spool_bytes is a gauge
+// computed on demand from theSpool instead, since it's cheap to recompute
+// and always reflects what's actually on disk.
+var statBytesWritten int64
+var statBytesDropped int64
+var statMsgsDropped int64
+var statReconnects int64
+
+type statsSnapshot struct {
+	BytesWritten int64 `json:"bytes_written"`
+	BytesDropped int64 `json:"bytes_dropped"`
+	MsgsDropped  int64 `json:"msgs_dropped"`
+	Reconnects   int64 `json:"reconnects"`
+	SpoolBytes   int64 `json:"spool_bytes"`
+}
+
+func currentStats() statsSnapshot {
+	var spoolBytes int64
+	if theSpool != nil {
+		spoolBytes = theSpool.Bytes()
+	}
+	return statsSnapshot{
+		BytesWritten: atomic.LoadInt64(&statBytesWritten),
+		BytesDropped: atomic.LoadInt64(&statBytesDropped),
+		MsgsDropped:  atomic.LoadInt64(&statMsgsDropped),
+		Reconnects:   atomic.LoadInt64(&statReconnects),
+		SpoolBytes:   spoolBytes,
+	}
+}
+
+// startStatsServer serves the counters as JSON at / and as Prometheus text
+// exposition format at /metrics, in the background for the life of the
+// process.
+func startStatsServer(addr string) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(currentStats())
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		s := currentStats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "# TYPE logpipe_bytes_written_total counter\nlogpipe_bytes_written_total %d\n", s.BytesWritten)
+		fmt.Fprintf(w, "# TYPE logpipe_bytes_dropped_total counter\nlogpipe_bytes_dropped_total %d\n", s.BytesDropped)
+		fmt.Fprintf(w, "# TYPE logpipe_msgs_dropped_total counter\nlogpipe_msgs_dropped_total %d\n", s.MsgsDropped)
+		fmt.Fprintf(w, "# TYPE logpipe_reconnects_total counter\nlogpipe_reconnects_total %d\n", s.Reconnects)
+		fmt.Fprintf(w, "# TYPE logpipe_spool_bytes gauge\nlogpipe_spool_bytes %d\n", s.SpoolBytes)
+	})
+
+	go func() {
+		log.Printf("Serving stats on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("-stats-addr %s: %v", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,81 @@
+/* ======================================================================== */
+/* tls.go - optional TLS for TCP-based output sinks                         */
+/* ======================================================================== */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+)
+
+var f_tls_ca = flag.String("tls-ca", "",
+	"PEM file of CA certificates to trust for TLS sinks, system roots if empty")
+var f_tls_cert = flag.String("tls-cert", "",
+	"PEM file of the client certificate to present to TLS sinks")
+var f_tls_key = flag.String("tls-key", "",
+	"PEM file of the private key matching -tls-cert")
+var f_tls_server_name = flag.String("tls-server-name", "",
+	"Override the server name verified against a TLS sink's certificate")
+var f_tls_insecure_skip_verify = flag.Bool("tls-insecure-skip-verify", false,
+	"Skip certificate verification on TLS sinks (insecure)")
+
+// sharedTLSConfig is the *tls.Config every sink opting into TLS (via
+// ?tls=true on its -output URL) dials with. Built once at startup so a bad
+// -tls-ca/-tls-cert/-tls-key is a fatal config error, not a runtime surprise
+// the first time a sink tries to reconnect.
+var sharedTLSConfig *tls.Config
+
+func buildTLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		ServerName:         *f_tls_server_name,
+		InsecureSkipVerify: *f_tls_insecure_skip_verify,
+	}
+
+	if *f_tls_ca != "" {
+		pem, err := ioutil.ReadFile(*f_tls_ca)
+		if err != nil {
+			log.Fatalf("-tls-ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("-tls-ca %s: no certificates found", *f_tls_ca)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if *f_tls_cert != "" || *f_tls_key != "" {
+		if *f_tls_cert == "" || *f_tls_key == "" {
+			log.Fatal("-tls-cert and -tls-key must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(*f_tls_cert, *f_tls_key)
+		if err != nil {
+			log.Fatalf("-tls-cert/-tls-key: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg
+}
+
+// tlsDial dials a TCP-like network/address and, if cfg is non-nil, performs
+// a TLS handshake over the new connection before returning it.
+func tlsDial(network string, address string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}